@@ -2,15 +2,18 @@ package controllers
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
 
-	batchv1 "k8s.io/api/batch/v1"
 	"k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
@@ -37,12 +40,23 @@ var (
 )
 
 const (
-	// maxRetries is the number of times a deployment will be retried before it is dropped out of the queue.
-	// With the current rate-limiter in use (5ms*2^(maxRetries-1)) the following numbers represent the times
-	// a deployment is going to be requeued:
-	//
-	// 5ms, 10ms, 20ms
-	maxRetries = 3
+	// defaultMaxRetries is the default number of times a replica will be
+	// retried before it is dropped out of the queue, used when
+	// NewReplicaController is given maxRetries <= 0.
+	defaultMaxRetries = 12
+
+	// defaultBurstReplicas caps how many replica pod creations/deletions
+	// this controller may have in flight across all replicas at once, used
+	// when NewReplicaController is given burstReplicas <= 0. This keeps a
+	// mass event, e.g. a node reboot that needs to recreate many replica
+	// pods at once, from overwhelming the API server.
+	defaultBurstReplicas = 500
+
+	// burstSlowStartInitialDelay/burstSlowStartMaxDelay bound how long a
+	// replica waits to be re-evaluated after hitting the burst budget,
+	// doubling on each repeated hit for the same key. See slowStartDelay.
+	burstSlowStartInitialDelay = 100 * time.Millisecond
+	burstSlowStartMaxDelay     = 30 * time.Second
 
 	// longhornDirectory is the directory going to be bind mounted on the
 	// host to provide storage space to replica data
@@ -51,6 +65,30 @@ const (
 	// longhornReplicaKey is the key to identify which volume the replica
 	// belongs to, for scheduling purpose
 	longhornReplicaKey = "longhorn-volume-replica"
+
+	// replicaPort is the port the engine replica process listens on inside
+	// the pod, used both for the launch command and the health probes.
+	replicaPort = 9502
+
+	// defaultProbeInitialDelaySeconds/defaultProbePeriodSeconds are used for
+	// the pod's liveness/readiness probes when Replica.Spec doesn't override
+	// them.
+	defaultProbeInitialDelaySeconds = 5
+	defaultProbePeriodSeconds       = 10
+
+	// defaultUnhealthyThresholdSeconds is how long the pod's Ready condition
+	// must stay False before the controller marks the replica as failed.
+	defaultUnhealthyThresholdSeconds = 30
+
+	// storageProviderHostPath and storageProviderPVC are the values accepted
+	// by Replica.Spec.StorageProvider. A replica without one set defaults to
+	// storageProviderHostPath for backwards compatibility.
+	storageProviderHostPath = "hostPath"
+	storageProviderPVC      = "pvc"
+
+	// replicaDataPVCSuffix is appended to the replica name to name its
+	// per-replica PVC when using storageProviderPVC.
+	replicaDataPVCSuffix = "-data"
 )
 
 type ReplicaController struct {
@@ -60,6 +98,38 @@ type ReplicaController struct {
 	eventRecorder record.EventRecorder
 	podControl    controller.PodControlInterface
 
+	// expectations tracks in-flight pod creations/deletions per replica so
+	// that syncReplica doesn't issue a duplicate startReplicaInstance or
+	// stopReplicaInstance call while the pod informer cache is still catching
+	// up with a request we already made.
+	expectations controller.ControllerExpectationsInterface
+
+	// hostPathProvider and pvcProvider back Replica.Spec.StorageProvider ==
+	// storageProviderHostPath / storageProviderPVC respectively. See
+	// storageProvider.
+	hostPathProvider *HostPathProvider
+	pvcProvider      *PVCProvider
+
+	// maxRetries is the number of times a replica sync will be retried
+	// before it is dropped out of the queue.
+	maxRetries int
+
+	// burstReplicas caps the number of replica pod creations/deletions this
+	// controller may have in flight at once. burstTokens is a token bucket
+	// sized to burstReplicas: a token is held from the moment
+	// startReplicaInstance/stopReplicaInstance issues a request until the
+	// pod informer observes the resulting create/delete.
+	burstReplicas int
+	burstTokens   chan struct{}
+
+	// burstHits counts, per replica key, how many consecutive times that
+	// replica has hit the burst budget since it last got through. It backs
+	// slowStartDelay's doubling: workqueue.NumRequeues only increments via
+	// AddRateLimited (sync errors and enqueueReplica), but hitting the burst
+	// limit requeues via AddAfter, so it needs its own counter.
+	burstHitsMu sync.Mutex
+	burstHits   map[string]int
+
 	lhClient lhclientset.Interface
 
 	// To allow injection for testing
@@ -81,12 +151,30 @@ type Replica struct {
 	namespace string
 }
 
-func NewReplicaController(replicaInformer lhinformers.ReplicaInformer, podInformer coreinformers.PodInformer, lhClient lhclientset.Interface, kubeClient clientset.Interface, namespace string) *ReplicaController {
+// NewReplicaController wires up a ReplicaController. maxRetries and
+// burstReplicas may be left at 0 to get defaultMaxRetries/defaultBurstReplicas.
+func NewReplicaController(replicaInformer lhinformers.ReplicaInformer, podInformer coreinformers.PodInformer, lhClient lhclientset.Interface, kubeClient clientset.Interface, namespace string, burstReplicas, maxRetries int) *ReplicaController {
+	if burstReplicas <= 0 {
+		burstReplicas = defaultBurstReplicas
+	}
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(logrus.Infof)
 	// TODO: remove the wrapper when every clients have moved to use the clientset.
 	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(kubeClient.CoreV1().RESTClient()).Events("")})
 
+	// Two-bucket rate limiter: a per-item exponential backoff so a
+	// persistently failing replica doesn't spin the queue, plus a
+	// cluster-wide token bucket so a burst of enqueues (e.g. many replicas
+	// all changing desired state at once) doesn't all fire immediately.
+	rateLimiter := workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(5*time.Millisecond, 1000*time.Second),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+
 	rc := &ReplicaController{
 		namespace: namespace,
 
@@ -98,7 +186,17 @@ func NewReplicaController(replicaInformer lhinformers.ReplicaInformer, podInform
 			KubeClient: kubeClient,
 			Recorder:   eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "longhorn-replica-controller"}),
 		},
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "longhorn-replica"),
+		expectations:     controller.NewControllerExpectations(),
+		hostPathProvider: NewHostPathProvider(kubeClient, namespace),
+		pvcProvider:      NewPVCProvider(kubeClient, namespace),
+		maxRetries:       maxRetries,
+		burstReplicas:    burstReplicas,
+		burstTokens:      make(chan struct{}, burstReplicas),
+		burstHits:        make(map[string]int),
+		queue:            workqueue.NewNamedRateLimitingQueue(rateLimiter, "longhorn-replica"),
+	}
+	for i := 0; i < burstReplicas; i++ {
+		rc.burstTokens <- struct{}{}
 	}
 
 	replicaInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -180,7 +278,7 @@ func (rc *ReplicaController) handleErr(err error, key interface{}) {
 		return
 	}
 
-	if rc.queue.NumRequeues(key) < maxRetries {
+	if rc.queue.NumRequeues(key) < rc.maxRetries {
 		logrus.Warnf("Error syncing Longhorn replica %v: %v", key, err)
 		rc.queue.AddRateLimited(key)
 		return
@@ -212,15 +310,21 @@ func (rc *ReplicaController) syncReplica(key string) error {
 
 	replica := replicaRO.DeepCopy()
 
-	// sync up with pod status
-	pod, err := rc.pLister.Pods(rc.namespace).Get(replica.Name)
+	rSatisfied := rc.expectations.SatisfiedExpectations(key)
+
+	// Adopt orphaned pods matching this replica's volume, release pods that
+	// no longer match, and use the (at most one, outside of a migration) pod
+	// we actually own as authoritative for Status.State.
+	pods, err := rc.claimReplicaPods(replica)
 	if err != nil {
-		if apierrors.IsNotFound(err) {
-			replica.Status.State = types.InstanceStateStopped
-		} else {
-			return err
-		}
+		return err
+	}
+
+	var pod *v1.Pod
+	if len(pods) == 0 {
+		replica.Status.State = types.InstanceStateStopped
 	} else {
+		pod = pods[0]
 		switch pod.Status.Phase {
 		case v1.PodPending:
 			replica.Status.State = types.InstanceStateStopped
@@ -233,6 +337,9 @@ func (rc *ReplicaController) syncReplica(key string) error {
 		}
 	}
 
+	rc.updateReplicaConditions(replica, pod)
+	rc.evaluateReplicaHealth(replica, key)
+
 	if replica.Spec.FailedAt != "" && replica.Spec.DesireState != types.InstanceStateStopped {
 		replica.Spec.DesireState = types.InstanceStateStopped
 		_, err := rc.updateReplicaHandler(replica)
@@ -259,12 +366,41 @@ func (rc *ReplicaController) syncReplica(key string) error {
 	}
 
 	if state != desireState {
+		if !rSatisfied {
+			// We've already asked for a pod to be created or deleted for this
+			// replica and haven't observed it yet in pLister. Don't issue
+			// another request; wait for the pod informer to catch up and
+			// requeue us.
+			logrus.Debugf("Replica %v expectations not satisfied, skip sync", key)
+			return nil
+		}
+		// desireState == InstanceStateDeleted with state == InstanceStateStopped
+		// only reaches the InstanceStateDeleted case's cleanupReplicaInstance,
+		// which doesn't touch a pod and so doesn't need burst budget.
+		needsPodOp := !(desireState == types.InstanceStateDeleted && state == types.InstanceStateStopped)
+		if needsPodOp && !rc.tryAcquireBurstToken() {
+			hits := rc.recordBurstHit(key)
+			delay := slowStartDelay(hits - 1)
+			logrus.Warnf("Replica %v hit the %v-wide pod create/delete burst limit, retrying in %v", key, rc.burstReplicas, delay)
+			rc.queue.AddAfter(key, delay)
+			return nil
+		}
+		rc.resetBurstHits(key)
+
+		// podOpIssued tracks whether one of the branches below actually
+		// called startReplicaInstance/stopReplicaInstance, which are
+		// responsible for releasing the token they were handed (on error
+		// immediately, on success once the pod informer observes the
+		// result). The no-op/error branches never call either, so they must
+		// release the token acquired above themselves or it leaks forever.
+		podOpIssued := false
 		switch desireState {
 		case types.InstanceStateRunning:
 			if state == types.InstanceStateStopped {
 				if err := rc.startReplicaInstance(replica); err != nil {
 					return err
 				}
+				podOpIssued = true
 				break
 			}
 			logrus.Errorf("unknown replica transition: current %v, desire %v", state, desireState)
@@ -273,6 +409,7 @@ func (rc *ReplicaController) syncReplica(key string) error {
 				if err := rc.stopReplicaInstance(replica); err != nil {
 					return err
 				}
+				podOpIssued = true
 				break
 			}
 			logrus.Errorf("unknown replica transition: current %v, desire %v", state, desireState)
@@ -281,6 +418,7 @@ func (rc *ReplicaController) syncReplica(key string) error {
 				if err := rc.stopReplicaInstance(replica); err != nil {
 					return err
 				}
+				podOpIssued = true
 			}
 			if state == types.InstanceStateStopped {
 				if err := rc.cleanupReplicaInstance(replica); err != nil {
@@ -288,10 +426,15 @@ func (rc *ReplicaController) syncReplica(key string) error {
 				}
 				break
 			}
-			logrus.Errorf("unable to delete replica due to unknown state %v", state)
+			if !podOpIssued {
+				logrus.Errorf("unable to delete replica due to unknown state %v", state)
+			}
 		default:
 			logrus.Errorf("unknown replica transition: current %v, desire %v", state, desireState)
 		}
+		if needsPodOp && !podOpIssued {
+			rc.releaseBurstToken()
+		}
 	}
 	return nil
 }
@@ -312,6 +455,14 @@ func (rc *ReplicaController) updateReplica(r *longhorn.Replica) (*longhorn.Repli
 
 func (rc *ReplicaController) deleteReplica(r *longhorn.Replica) error {
 	name := r.Name
+
+	key, err := controller.KeyFunc(r)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Couldn't get key for object %#v: %v", r, err))
+	} else {
+		rc.expectations.DeleteExpectations(key)
+	}
+
 	result, err := rc.rLister.Replicas(r.Namespace).Get(name)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
@@ -337,14 +488,51 @@ func (rc *ReplicaController) deleteReplica(r *longhorn.Replica) error {
 	return nil
 }
 
-func (rc *ReplicaController) getReplicaVolumeDirectory(replicaName string) string {
-	return longhornDirectory + "/replicas/" + replicaName
+// storageProvider returns the ReplicaStorageProvider backing r, selected by
+// Spec.StorageProvider. Replicas created before this field existed default to
+// storageProviderHostPath.
+func (rc *ReplicaController) storageProvider(r *longhorn.Replica) ReplicaStorageProvider {
+	switch r.Spec.StorageProvider {
+	case storageProviderPVC:
+		return rc.pvcProvider
+	default:
+		return rc.hostPathProvider
+	}
+}
+
+// probeInitialDelaySeconds, probePeriodSeconds and unhealthyThreshold return
+// r.Spec's probe tuning fields, falling back to the controller defaults when
+// the operator hasn't set them for this volume.
+func probeInitialDelaySeconds(r *longhorn.Replica) int32 {
+	if r.Spec.ProbeInitialDelay != 0 {
+		return r.Spec.ProbeInitialDelay
+	}
+	return defaultProbeInitialDelaySeconds
+}
+
+func probePeriodSeconds(r *longhorn.Replica) int32 {
+	if r.Spec.ProbePeriod != 0 {
+		return r.Spec.ProbePeriod
+	}
+	return defaultProbePeriodSeconds
+}
+
+func unhealthyThreshold(r *longhorn.Replica) time.Duration {
+	if r.Spec.UnhealthyThreshold != 0 {
+		return time.Duration(r.Spec.UnhealthyThreshold) * time.Second
+	}
+	return defaultUnhealthyThresholdSeconds * time.Second
 }
 
-func (rc *ReplicaController) createPodTemplateSpec(r *longhorn.Replica) *v1.PodTemplateSpec {
+func (rc *ReplicaController) createPodTemplateSpec(r *longhorn.Replica) (*v1.PodTemplateSpec, error) {
+	volumeSource, err := rc.storageProvider(r).PrepareVolume(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare replica storage")
+	}
+
 	cmd := []string{
 		"launch", "replica",
-		"--listen", "0.0.0.0:9502",
+		"--listen", fmt.Sprintf("0.0.0.0:%v", replicaPort),
 		"--size", r.Spec.VolumeSize,
 	}
 	if r.Spec.RestoreFrom != "" && r.Spec.RestoreName != "" {
@@ -352,6 +540,24 @@ func (rc *ReplicaController) createPodTemplateSpec(r *longhorn.Replica) *v1.PodT
 	}
 	cmd = append(cmd, "/volume")
 
+	// The engine replica speaks a raw TCP protocol, not HTTP/gRPC, so the
+	// probe checks that the listener is accepting connections. This is only
+	// wired up as a ReadinessProbe: the pod's RestartPolicy is Never, so a
+	// LivenessProbe failure would have the kubelet kill the container outright
+	// instead of leaving evaluateReplicaHealth's UnhealthyThreshold in charge
+	// of deciding when a replica is actually failed.
+	newProbe := func() *v1.Probe {
+		return &v1.Probe{
+			Handler: v1.Handler{
+				TCPSocket: &v1.TCPSocketAction{
+					Port: intstr.FromInt(replicaPort),
+				},
+			},
+			InitialDelaySeconds: probeInitialDelaySeconds(r),
+			PeriodSeconds:       probePeriodSeconds(r),
+		}
+	}
+
 	privilege := true
 	pod := &v1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
@@ -370,6 +576,7 @@ func (rc *ReplicaController) createPodTemplateSpec(r *longhorn.Replica) *v1.PodT
 					SecurityContext: &v1.SecurityContext{
 						Privileged: &privilege,
 					},
+					ReadinessProbe: newProbe(),
 					VolumeMounts: []v1.VolumeMount{
 						{
 							Name:      "volume",
@@ -380,12 +587,8 @@ func (rc *ReplicaController) createPodTemplateSpec(r *longhorn.Replica) *v1.PodT
 			},
 			Volumes: []v1.Volume{
 				{
-					Name: "volume",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: rc.getReplicaVolumeDirectory(r.Name),
-						},
-					},
+					Name:         "volume",
+					VolumeSource: *volumeSource,
 				},
 			},
 		},
@@ -414,76 +617,49 @@ func (rc *ReplicaController) createPodTemplateSpec(r *longhorn.Replica) *v1.PodT
 			},
 		}
 	}
-	return pod
+	return pod, nil
 }
 
-func (rc *ReplicaController) createCleanupJobSpec(r *longhorn.Replica) *batchv1.Job {
-	cmd := []string{"/bin/bash", "-c"}
-	// There is a delay between starting pod and mount the volume, so
-	// workaround it for now
-	args := []string{"sleep 1 && rm -f /volume/*"}
-
-	jobName := r.Name
-	backoffLimit := int32(1)
-	job := &batchv1.Job{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:            jobName,
-			Namespace:       r.Namespace,
-			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(r, controllerKind)},
-		},
-		Spec: batchv1.JobSpec{
-			BackoffLimit: &backoffLimit,
-			Template: v1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: "cleanup-" + r.Name,
-				},
-				Spec: v1.PodSpec{
-					NodeName:      r.Spec.NodeID,
-					RestartPolicy: v1.RestartPolicyNever,
-					Containers: []v1.Container{
-						{
-							Name:    "cleanup-" + r.Name,
-							Image:   r.Spec.EngineImage,
-							Command: cmd,
-							Args:    args,
-							VolumeMounts: []v1.VolumeMount{
-								{
-									Name:      "volume",
-									MountPath: "/volume",
-								},
-							},
-						},
-					},
-					Volumes: []v1.Volume{
-						{
-							Name: "volume",
-							VolumeSource: v1.VolumeSource{
-								HostPath: &v1.HostPathVolumeSource{
-									Path: rc.getReplicaVolumeDirectory(r.Name),
-								},
-							},
-						},
-					},
-				},
-			},
-		},
+// startReplicaInstance and stopReplicaInstance are only called once the
+// caller has acquired a burst token for this pod op; every return path below
+// must account for it exactly once, either by releasing it here on failure
+// or by leaving it held for addPod/deletePod to release once the informer
+// observes the result.
+func (rc *ReplicaController) startReplicaInstance(r *longhorn.Replica) (err error) {
+	rKey, err := controller.KeyFunc(r)
+	if err != nil {
+		rc.releaseBurstToken()
+		return fmt.Errorf("couldn't get key for object %#v: %v", r, err)
 	}
-	return job
-}
 
-func (rc *ReplicaController) startReplicaInstance(r *longhorn.Replica) (err error) {
-	podSpec := rc.createPodTemplateSpec(r)
+	podSpec, err := rc.createPodTemplateSpec(r)
+	if err != nil {
+		rc.releaseBurstToken()
+		return err
+	}
 
+	rc.expectations.ExpectCreations(rKey, 1)
 	logrus.Debugf("Starting replica %v for %v", r.Name, r.Spec.VolumeName)
 	if err := rc.podControl.CreatePodsWithControllerRef(rc.namespace, podSpec, r, metav1.NewControllerRef(r, controllerKind)); err != nil {
+		rc.expectations.CreationObserved(rKey)
+		rc.releaseBurstToken()
 		return err
 	}
 	return nil
 }
 
 func (rc *ReplicaController) stopReplicaInstance(r *longhorn.Replica) (err error) {
+	rKey, err := controller.KeyFunc(r)
+	if err != nil {
+		rc.releaseBurstToken()
+		return fmt.Errorf("couldn't get key for object %#v: %v", r, err)
+	}
+
+	rc.expectations.ExpectDeletions(rKey, 1)
 	logrus.Debugf("Stopping replica %v for %v", r.Name, r.Spec.VolumeName)
 	if err := rc.podControl.DeletePod(rc.namespace, r.Name, r); err != nil {
+		rc.expectations.DeletionObserved(rKey)
+		rc.releaseBurstToken()
 		return err
 	}
 	return nil
@@ -494,38 +670,30 @@ func (rc *ReplicaController) cleanupReplicaInstance(r *longhorn.Replica) (err er
 	if r.Spec.NodeID == "" {
 		return nil
 	}
-	job, err := rc.kubeClient.BatchV1().Jobs(rc.namespace).Get(r.Name, metav1.GetOptions{})
-	if err != nil && !apierrors.IsNotFound(err) {
-		return err
+
+	finished, succeeded, err := rc.storageProvider(r).Cleanup(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to clean up replica storage")
+	}
+	if !finished {
+		return nil
 	}
-	if job == nil {
-		job := rc.createCleanupJobSpec(r)
 
-		_, err = rc.kubeClient.BatchV1().Jobs(rc.namespace).Create(job)
-		if err != nil {
-			return errors.Wrap(err, "failed to create cleanup job")
+	if succeeded {
+		logrus.Infof("Cleanup for volume %v replica %v succeed", r.Spec.VolumeName, r.Name)
+		r.Status.State = types.InstanceStateDeleted
+		setReplicaCondition(&r.Status, newReplicaCondition(longhorn.ReplicaConditionTypeCleanupSucceeded, v1.ConditionTrue,
+			"CleanupSucceeded", fmt.Sprintf("storage cleanup for replica %v completed", r.Name)))
+		if _, err := rc.updateReplicaHandler(r); err != nil {
+			return err
 		}
 	} else {
-		if job.Status.CompletionTime != nil {
-			defer func() {
-				err := rc.kubeClient.BatchV1().Jobs(rc.namespace).Delete(r.Name, &metav1.DeleteOptions{})
-				if err != nil {
-					logrus.Warnf("Failed to delete the cleanup job for %v: %v", r.Name, err)
-				}
-			}()
-
-			if job.Status.Succeeded != 0 {
-				logrus.Infof("Cleanup for volume %v replica %v succeed", r.Spec.VolumeName, r.Name)
-				r.Status.State = types.InstanceStateDeleted
-				if _, err := rc.updateReplicaHandler(r); err != nil {
-					return err
-				}
-			} else {
-				logrus.Warnf("Cleanup for volume %v replica %v failed", r.Spec.VolumeName, r.Name)
-			}
-			rc.enqueueReplicaHandler(r)
-		}
+		logrus.Warnf("Cleanup for volume %v replica %v failed", r.Spec.VolumeName, r.Name)
+		setReplicaCondition(&r.Status, newReplicaCondition(longhorn.ReplicaConditionTypeCleanupSucceeded, v1.ConditionFalse,
+			"CleanupFailed", fmt.Sprintf("storage cleanup for replica %v did not succeed", r.Name)))
+		rc.eventRecorder.Eventf(r, v1.EventTypeWarning, "CleanupFailed", "storage cleanup for replica %v did not succeed", r.Name)
 	}
+	rc.enqueueReplicaHandler(r)
 
 	return nil
 }
@@ -537,6 +705,13 @@ func (rc *ReplicaController) addPod(obj interface{}) {
 		if replica == nil {
 			return
 		}
+		rKey, err := controller.KeyFunc(replica)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("Couldn't get key for object %#v: %v", replica, err))
+			return
+		}
+		rc.expectations.CreationObserved(rKey)
+		rc.releaseBurstToken()
 		rc.enqueueReplicaHandler(replica)
 		return
 	}
@@ -588,9 +763,239 @@ func (rc *ReplicaController) deletePod(obj interface{}) {
 	if replica == nil {
 		return
 	}
+	rKey, err := controller.KeyFunc(replica)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Couldn't get key for object %#v: %v", replica, err))
+		return
+	}
+	rc.expectations.DeletionObserved(rKey)
+	rc.releaseBurstToken()
 	rc.enqueueReplicaHandler(replica)
 }
 
+// tryAcquireBurstToken claims one slot of the controller-wide pod
+// create/delete burst budget, returning false if none is free.
+func (rc *ReplicaController) tryAcquireBurstToken() bool {
+	select {
+	case <-rc.burstTokens:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseBurstToken returns a slot to the burst budget. It's a no-op if the
+// bucket is already full, which should only happen if a caller releases a
+// token it never acquired.
+func (rc *ReplicaController) releaseBurstToken() {
+	select {
+	case rc.burstTokens <- struct{}{}:
+	default:
+	}
+}
+
+// recordBurstHit records another consecutive burst-budget hit for key and
+// returns the new count.
+func (rc *ReplicaController) recordBurstHit(key string) int {
+	rc.burstHitsMu.Lock()
+	defer rc.burstHitsMu.Unlock()
+	rc.burstHits[key]++
+	return rc.burstHits[key]
+}
+
+// resetBurstHits clears key's consecutive burst-budget hit count, called
+// once it's gotten through the burst check again.
+func (rc *ReplicaController) resetBurstHits(key string) {
+	rc.burstHitsMu.Lock()
+	defer rc.burstHitsMu.Unlock()
+	delete(rc.burstHits, key)
+}
+
+// slowStartDelay computes how long to wait before re-evaluating a replica
+// that's blocked on the burst budget, doubling from burstSlowStartInitialDelay
+// for each previous requeue of the same key, capped at burstSlowStartMaxDelay.
+func slowStartDelay(retries int) time.Duration {
+	const maxDoublings = 8
+	if retries > maxDoublings {
+		retries = maxDoublings
+	}
+	delay := burstSlowStartInitialDelay * time.Duration(int64(1)<<uint(retries))
+	if delay > burstSlowStartMaxDelay {
+		delay = burstSlowStartMaxDelay
+	}
+	return delay
+}
+
+// newReplicaCondition creates a ReplicaCondition, stamping both probe and
+// transition times with the current time. Callers that are refreshing an
+// existing condition should rely on setReplicaCondition to preserve the
+// original LastTransitionTime when Status hasn't changed.
+func newReplicaCondition(condType longhorn.ReplicaConditionType, status v1.ConditionStatus, reason, message string) longhorn.ReplicaCondition {
+	return longhorn.ReplicaCondition{
+		Type:               condType,
+		Status:             status,
+		LastProbeTime:      metav1.Now(),
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+}
+
+// getReplicaCondition returns the condition of the given type, or nil if the
+// replica doesn't have one yet.
+func getReplicaCondition(status longhorn.ReplicaStatus, condType longhorn.ReplicaConditionType) *longhorn.ReplicaCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setReplicaCondition adds or updates the condition of the given type,
+// keeping LastTransitionTime unchanged unless Status actually flipped.
+func setReplicaCondition(status *longhorn.ReplicaStatus, condition longhorn.ReplicaCondition) {
+	if current := getReplicaCondition(*status, condition.Type); current != nil && current.Status == condition.Status {
+		condition.LastTransitionTime = current.LastTransitionTime
+	}
+	conditions := status.Conditions[:0]
+	for _, c := range status.Conditions {
+		if c.Type != condition.Type {
+			conditions = append(conditions, c)
+		}
+	}
+	status.Conditions = append(conditions, condition)
+}
+
+// updateReplicaConditions refreshes replica.Status.Conditions from the owned
+// pod's own conditions (when there is one) and from Spec.FailedAt. It sets
+// Spec.FailedAt when the pod is in phase Failed or Unknown, and emits a
+// Warning event when the Failed condition's Status changes; transitions of
+// the other conditions emit no event. pod may be nil when the replica
+// currently owns no pod.
+func (rc *ReplicaController) updateReplicaConditions(replica *longhorn.Replica, pod *v1.Pod) {
+	previousFailed := getReplicaCondition(replica.Status, longhorn.ReplicaConditionTypeFailed)
+	failedConditionSetThisSync := false
+
+	if pod != nil {
+		if podScheduled := getPodCondition(pod, v1.PodScheduled); podScheduled != nil {
+			setReplicaCondition(&replica.Status, newReplicaCondition(
+				longhorn.ReplicaConditionTypeScheduled, podScheduled.Status, podScheduled.Reason, podScheduled.Message))
+		}
+		if podReady := getPodCondition(pod, v1.PodReady); podReady != nil {
+			readyCondition := newReplicaCondition(
+				longhorn.ReplicaConditionTypeReady, podReady.Status, podReady.Reason, podReady.Message)
+			// Carry over the pod's own transition time so evaluateReplicaHealth
+			// measures how long the pod has really been unready, even when the
+			// replica's conditions from earlier syncs were never persisted.
+			if !podReady.LastTransitionTime.IsZero() {
+				readyCondition.LastTransitionTime = podReady.LastTransitionTime
+			}
+			setReplicaCondition(&replica.Status, readyCondition)
+		}
+
+		if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodUnknown {
+			setReplicaCondition(&replica.Status, newReplicaCondition(longhorn.ReplicaConditionTypeFailed, v1.ConditionTrue,
+				"Pod"+string(pod.Status.Phase), fmt.Sprintf("pod %v is in phase %v", pod.Name, pod.Status.Phase)))
+			failedConditionSetThisSync = true
+			if replica.Spec.FailedAt == "" {
+				replica.Spec.FailedAt = metav1.Now().Format(time.RFC3339)
+			}
+		}
+	}
+
+	// Only fall back to the generic FailedAtSet reason if nothing more
+	// specific already set the Failed condition above this sync; otherwise
+	// this would stomp the real root cause (e.g. "PodFailed") right after
+	// it was set.
+	if replica.Spec.FailedAt != "" && !failedConditionSetThisSync {
+		setReplicaCondition(&replica.Status, newReplicaCondition(longhorn.ReplicaConditionTypeFailed, v1.ConditionTrue,
+			"FailedAtSet", fmt.Sprintf("replica marked failed at %v", replica.Spec.FailedAt)))
+	}
+
+	if newFailed := getReplicaCondition(replica.Status, longhorn.ReplicaConditionTypeFailed); newFailed != nil &&
+		(previousFailed == nil || previousFailed.Status != newFailed.Status) {
+		rc.eventRecorder.Eventf(replica, v1.EventTypeWarning, newFailed.Reason, newFailed.Message)
+	}
+}
+
+// evaluateReplicaHealth marks a replica failed once its Ready condition has
+// stayed False for longer than its unhealthy threshold, mirroring how
+// kubelet marks a pod unhealthy once its readiness probe keeps failing.
+// Until the threshold has elapsed it schedules a requeue for when it will,
+// so the replica is re-evaluated even if no informer event fires in the
+// meantime.
+func (rc *ReplicaController) evaluateReplicaHealth(replica *longhorn.Replica, key string) {
+	if replica.Spec.FailedAt != "" {
+		return
+	}
+
+	ready := getReplicaCondition(replica.Status, longhorn.ReplicaConditionTypeReady)
+	if ready == nil || ready.Status != v1.ConditionFalse {
+		return
+	}
+
+	threshold := unhealthyThreshold(replica)
+	unhealthyFor := time.Since(ready.LastTransitionTime.Time)
+	if unhealthyFor < threshold {
+		rc.queue.AddAfter(key, threshold-unhealthyFor)
+		return
+	}
+
+	logrus.Warnf("volume %v replica %v has been unhealthy for %v, marking failed", replica.Spec.VolumeName, replica.Name, unhealthyFor)
+	replica.Spec.FailedAt = metav1.Now().Format(time.RFC3339)
+	rc.eventRecorder.Eventf(replica, v1.EventTypeWarning, "Unhealthy", "replica %v has not been ready for %v", replica.Name, unhealthyFor)
+}
+
+// getPodCondition returns the pod condition of the given type, or nil if the
+// pod doesn't report one.
+func getPodCondition(pod *v1.Pod, condType v1.PodConditionType) *v1.PodCondition {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == condType {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// claimReplicaPods lists all pods in the namespace whose longhornReplicaKey
+// label matches this replica's volume and reconciles ownership of them via a
+// controller.PodControllerRefManager: pods already controlled by r are kept,
+// orphans matching this replica are adopted, and pods we control but that no
+// longer match are released. The returned pods are the ones r owns after
+// reconciliation.
+//
+// longhornReplicaKey alone isn't enough to scope adoption to r: every
+// replica of a volume shares it (normally 2-3 of them), so an orphaned pod
+// belonging to a sibling replica would otherwise be up for grabs here too.
+// ClaimPods is additionally restricted with a byName filter requiring
+// pod.Name == r.Name, which has always been the case for every pod this
+// controller creates (see createPodTemplateSpec) and, unlike a label, is
+// also true of pods created by a version of this controller that predates
+// this filter.
+func (rc *ReplicaController) claimReplicaPods(r *longhorn.Replica) ([]*v1.Pod, error) {
+	selector := labels.SelectorFromSet(labels.Set{longhornReplicaKey: r.Spec.VolumeName})
+	byName := func(pod *v1.Pod) bool { return pod.Name == r.Name }
+
+	pods, err := rc.pLister.Pods(rc.namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	canAdoptFunc := controller.RecheckDeletionTimestamp(func() (metav1.Object, error) {
+		fresh, err := rc.lhClient.LonghornV1alpha1().Replicas(rc.namespace).Get(r.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if fresh.UID != r.UID {
+			return nil, fmt.Errorf("original Replica %v/%v is gone: got uid %v, wanted %v", rc.namespace, r.Name, fresh.UID, r.UID)
+		}
+		return fresh, nil
+	})
+	cm := controller.NewPodControllerRefManager(rc.podControl, r, selector, controllerKind, canAdoptFunc)
+	return cm.ClaimPods(pods, byName)
+}
+
 // resolveControllerRef returns the controller referenced by a ControllerRef,
 // or nil if the ControllerRef could not be resolved to a matching controller
 // of the correct Kind.
@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/controller"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+)
+
+const testNamespace = "longhorn-system"
+
+func newTestReplica(name, volumeName string) *longhorn.Replica {
+	return &longhorn.Replica{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			UID:       "test-uid",
+		},
+		Spec: longhorn.ReplicaSpec{
+			VolumeName:  volumeName,
+			VolumeSize:  "1g",
+			EngineImage: "rancher/longhorn-engine:latest",
+			DesireState: types.InstanceStateRunning,
+		},
+	}
+}
+
+// newTestController wires up a ReplicaController against fake clientsets and
+// a FakePodControl so syncReplica can be exercised without a real API server.
+func newTestController(objects ...*longhorn.Replica) (*ReplicaController, *controller.FakePodControl) {
+	rc, fakePodControl, _ := newTestControllerWithBurst(0, objects...)
+	return rc, fakePodControl
+}
+
+// newTestControllerWithBurst is newTestController with an explicit burst
+// budget, for exercising the burst-limited path. It also returns the pod
+// informer so callers can seed pods directly into its store, the way objects
+// seeds the replica informer's.
+func newTestControllerWithBurst(burstReplicas int, objects ...*longhorn.Replica) (*ReplicaController, *controller.FakePodControl, coreinformers.PodInformer) {
+	lhClient := lhfake.NewSimpleClientset()
+	kubeClient := k8sfake.NewSimpleClientset()
+
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, 0)
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+
+	replicaInformer := lhInformerFactory.Longhorn().V1alpha1().Replicas()
+	podInformer := kubeInformerFactory.Core().V1().Pods()
+
+	for _, r := range objects {
+		replicaInformer.Informer().GetStore().Add(r)
+		lhClient.LonghornV1alpha1().Replicas(testNamespace).Create(r)
+	}
+
+	rc := NewReplicaController(replicaInformer, podInformer, lhClient, kubeClient, testNamespace, burstReplicas, 0)
+
+	fakePodControl := &controller.FakePodControl{}
+	rc.podControl = fakePodControl
+
+	return rc, fakePodControl, podInformer
+}
+
+// TestSyncReplicaExpectationsPreventDuplicateCreate verifies that a second
+// syncReplica call for the same Replica, issued before the pod informer has
+// observed the pod created by the first call, does not create a second pod.
+func TestSyncReplicaExpectationsPreventDuplicateCreate(t *testing.T) {
+	replica := newTestReplica("replica-1", "vol-1")
+	rc, fakePodControl := newTestController(replica)
+
+	if err := rc.syncHandler(testNamespace + "/" + replica.Name); err != nil {
+		t.Fatalf("unexpected error from first sync: %v", err)
+	}
+	if len(fakePodControl.Templates) != 1 {
+		t.Fatalf("expected 1 pod creation after first sync, got %v", len(fakePodControl.Templates))
+	}
+
+	// The pod informer hasn't observed the new pod yet, so expectations for
+	// this replica are not satisfied and a second sync must be a no-op.
+	if err := rc.syncHandler(testNamespace + "/" + replica.Name); err != nil {
+		t.Fatalf("unexpected error from second sync: %v", err)
+	}
+	if len(fakePodControl.Templates) != 1 {
+		t.Fatalf("expected still 1 pod creation after second sync, got %v", len(fakePodControl.Templates))
+	}
+
+	// Once the pod informer observes the creation (simulated here by calling
+	// addPod directly), the expectations for this replica are satisfied.
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            replica.Name,
+			Namespace:       testNamespace,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(replica, controllerKind)},
+		},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+	rc.addPod(pod)
+
+	if err := wait.PollImmediate(10*time.Millisecond, time.Second, func() (bool, error) {
+		return rc.expectations.SatisfiedExpectations(testNamespace + "/" + replica.Name), nil
+	}); err != nil {
+		t.Fatalf("expectations were never satisfied after observing pod creation: %v", err)
+	}
+}
+
+// TestSyncReplicaBurstBudget verifies that once the burst budget is
+// exhausted, syncReplica stops creating pods for other replicas and instead
+// requeues them, rather than creating pods unboundedly.
+func TestSyncReplicaBurstBudget(t *testing.T) {
+	replicas := []*longhorn.Replica{
+		newTestReplica("replica-1", "vol-1"),
+		newTestReplica("replica-2", "vol-2"),
+	}
+	rc, fakePodControl, _ := newTestControllerWithBurst(1, replicas...)
+
+	if err := rc.syncHandler(testNamespace + "/" + replicas[0].Name); err != nil {
+		t.Fatalf("unexpected error syncing replica-1: %v", err)
+	}
+	if len(fakePodControl.Templates) != 1 {
+		t.Fatalf("expected 1 pod creation after replica-1 sync, got %v", len(fakePodControl.Templates))
+	}
+
+	// The single burst token is held until the pod informer observes the
+	// create, so a second replica hitting the budget must be a no-op rather
+	// than creating a pod.
+	if err := rc.syncHandler(testNamespace + "/" + replicas[1].Name); err != nil {
+		t.Fatalf("unexpected error syncing replica-2: %v", err)
+	}
+	if len(fakePodControl.Templates) != 1 {
+		t.Fatalf("expected still 1 pod creation while burst budget is exhausted, got %v", len(fakePodControl.Templates))
+	}
+	// syncReplica schedules the requeue via AddAfter with slowStartDelay's
+	// delay, so it only shows up in the queue once that delay elapses.
+	if err := wait.PollImmediate(10*time.Millisecond, time.Second, func() (bool, error) {
+		return rc.queue.Len() == 1, nil
+	}); err != nil {
+		t.Fatalf("replica-2 was never requeued after hitting the burst budget: %v", err)
+	}
+}
+
+// TestClaimReplicaPodsAdoptsOrphan verifies that an orphaned pod (no
+// ControllerRef) matching this replica is adopted.
+func TestClaimReplicaPodsAdoptsOrphan(t *testing.T) {
+	replica := newTestReplica("replica-1", "vol-1")
+	rc, _, podInformer := newTestControllerWithBurst(0, replica)
+
+	orphan := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      replica.Name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{longhornReplicaKey: replica.Spec.VolumeName},
+		},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+	podInformer.Informer().GetStore().Add(orphan)
+
+	pods, err := rc.claimReplicaPods(replica)
+	if err != nil {
+		t.Fatalf("unexpected error claiming pods: %v", err)
+	}
+	if len(pods) != 1 || pods[0].Name != replica.Name {
+		t.Fatalf("expected the orphaned pod to be adopted, got %v", pods)
+	}
+}
+
+// TestClaimReplicaPodsIgnoresForeignPod verifies that a pod already
+// controlled by a different replica is left alone rather than claimed, even
+// when it otherwise matches this replica's volume label.
+func TestClaimReplicaPodsIgnoresForeignPod(t *testing.T) {
+	replica := newTestReplica("replica-1", "vol-1")
+	sibling := newTestReplica("replica-1", "vol-1")
+	sibling.UID = "sibling-uid"
+	rc, _, podInformer := newTestControllerWithBurst(0, replica)
+
+	foreign := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            replica.Name,
+			Namespace:       testNamespace,
+			Labels:          map[string]string{longhornReplicaKey: replica.Spec.VolumeName},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(sibling, controllerKind)},
+		},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+	podInformer.Informer().GetStore().Add(foreign)
+
+	pods, err := rc.claimReplicaPods(replica)
+	if err != nil {
+		t.Fatalf("unexpected error claiming pods: %v", err)
+	}
+	if len(pods) != 0 {
+		t.Fatalf("expected the foreign-owned pod not to be claimed, got %v", pods)
+	}
+}
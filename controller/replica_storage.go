@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+// ReplicaStorageProvider supplies the backing storage for a replica pod's
+// /volume mount. HostPathProvider preserves the original behavior of a
+// host-local directory; PVCProvider backs a replica with a PersistentVolumeClaim
+// so the data can live on a CSI-provided filesystem or dedicated block device
+// instead.
+type ReplicaStorageProvider interface {
+	// PrepareVolume ensures whatever backing object the provider needs
+	// exists and returns the VolumeSource to mount at /volume in the
+	// replica pod.
+	PrepareVolume(r *longhorn.Replica) (*v1.VolumeSource, error)
+
+	// Cleanup tears down the storage backing r, which is being deleted.
+	// finished reports whether cleanup has run to completion; succeeded is
+	// only meaningful when finished is true.
+	Cleanup(r *longhorn.Replica) (finished bool, succeeded bool, err error)
+}
+
+// HostPathProvider is the original replica storage backend: a directory
+// bind-mounted from the host the replica pod is scheduled to.
+type HostPathProvider struct {
+	kubeClient clientset.Interface
+	namespace  string
+}
+
+func NewHostPathProvider(kubeClient clientset.Interface, namespace string) *HostPathProvider {
+	return &HostPathProvider{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+	}
+}
+
+func (p *HostPathProvider) volumeDirectory(replicaName string) string {
+	return longhornDirectory + "/replicas/" + replicaName
+}
+
+func (p *HostPathProvider) PrepareVolume(r *longhorn.Replica) (*v1.VolumeSource, error) {
+	return &v1.VolumeSource{
+		HostPath: &v1.HostPathVolumeSource{
+			Path: p.volumeDirectory(r.Name),
+		},
+	}, nil
+}
+
+// Cleanup runs a sleep+rm Job on the node the replica used to live on, since
+// there's no other way to remove data out of a host directory once the
+// replica pod itself is gone.
+func (p *HostPathProvider) Cleanup(r *longhorn.Replica) (bool, bool, error) {
+	job, err := p.kubeClient.BatchV1().Jobs(p.namespace).Get(r.Name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return false, false, err
+		}
+		if _, err := p.kubeClient.BatchV1().Jobs(p.namespace).Create(p.createCleanupJobSpec(r)); err != nil {
+			return false, false, errors.Wrap(err, "failed to create cleanup job")
+		}
+		return false, false, nil
+	}
+
+	if job.Status.CompletionTime == nil {
+		return false, false, nil
+	}
+
+	defer func() {
+		if err := p.kubeClient.BatchV1().Jobs(p.namespace).Delete(r.Name, &metav1.DeleteOptions{}); err != nil {
+			logrus.Warnf("Failed to delete the cleanup job for %v: %v", r.Name, err)
+		}
+	}()
+
+	return true, job.Status.Succeeded != 0, nil
+}
+
+func (p *HostPathProvider) createCleanupJobSpec(r *longhorn.Replica) *batchv1.Job {
+	cmd := []string{"/bin/bash", "-c"}
+	// There is a delay between starting pod and mount the volume, so
+	// workaround it for now
+	args := []string{"sleep 1 && rm -f /volume/*"}
+
+	jobName := r.Name
+	backoffLimit := int32(1)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            jobName,
+			Namespace:       r.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(r, controllerKind)},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "cleanup-" + r.Name,
+				},
+				Spec: v1.PodSpec{
+					NodeName:      r.Spec.NodeID,
+					RestartPolicy: v1.RestartPolicyNever,
+					Containers: []v1.Container{
+						{
+							Name:    "cleanup-" + r.Name,
+							Image:   r.Spec.EngineImage,
+							Command: cmd,
+							Args:    args,
+							VolumeMounts: []v1.VolumeMount{
+								{
+									Name:      "volume",
+									MountPath: "/volume",
+								},
+							},
+						},
+					},
+					Volumes: []v1.Volume{
+						{
+							Name: "volume",
+							VolumeSource: v1.VolumeSource{
+								HostPath: &v1.HostPathVolumeSource{
+									Path: p.volumeDirectory(r.Name),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// PVCProvider backs a replica with a dedicated PersistentVolumeClaim, named
+// "<replica>-data", so the data can live on whatever CSI driver or local-PV
+// the cluster provides instead of a host directory.
+type PVCProvider struct {
+	kubeClient clientset.Interface
+	namespace  string
+}
+
+func NewPVCProvider(kubeClient clientset.Interface, namespace string) *PVCProvider {
+	return &PVCProvider{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+	}
+}
+
+func (p *PVCProvider) pvcName(r *longhorn.Replica) string {
+	return r.Name + replicaDataPVCSuffix
+}
+
+func (p *PVCProvider) PrepareVolume(r *longhorn.Replica) (*v1.VolumeSource, error) {
+	name := p.pvcName(r)
+
+	_, err := p.kubeClient.CoreV1().PersistentVolumeClaims(p.namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		size, err := resource.ParseQuantity(r.Spec.VolumeSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid volume size %v", r.Spec.VolumeSize)
+		}
+		pvc := &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       p.namespace,
+				OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(r, controllerKind)},
+			},
+			Spec: v1.PersistentVolumeClaimSpec{
+				AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceStorage: size,
+					},
+				},
+			},
+		}
+		if r.Spec.StorageClass != "" {
+			pvc.Spec.StorageClassName = &r.Spec.StorageClass
+		}
+		if _, err := p.kubeClient.CoreV1().PersistentVolumeClaims(p.namespace).Create(pvc); err != nil {
+			return nil, errors.Wrap(err, "failed to create replica data PVC")
+		}
+	}
+
+	return &v1.VolumeSource{
+		PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+			ClaimName: name,
+		},
+	}, nil
+}
+
+// Cleanup deletes the replica's PVC. Unlike HostPathProvider there's no
+// cleanup Job to run: the CSI driver (or local-PV provisioner) is
+// responsible for reclaiming the underlying storage once the PVC is gone.
+func (p *PVCProvider) Cleanup(r *longhorn.Replica) (bool, bool, error) {
+	err := p.kubeClient.CoreV1().PersistentVolumeClaims(p.namespace).Delete(p.pvcName(r), &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, false, err
+	}
+	return true, true, nil
+}
@@ -0,0 +1,21 @@
+package controllers
+
+import (
+	"testing"
+
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+// TestPVCProviderPrepareVolumeInvalidSize verifies that an invalid
+// Spec.VolumeSize returns an error instead of panicking.
+func TestPVCProviderPrepareVolumeInvalidSize(t *testing.T) {
+	kubeClient := k8sfake.NewSimpleClientset()
+	p := NewPVCProvider(kubeClient, testNamespace)
+
+	replica := newTestReplica("replica-1", "vol-1")
+	replica.Spec.VolumeSize = "not-a-size"
+
+	if _, err := p.PrepareVolume(replica); err == nil {
+		t.Fatalf("expected an error for invalid VolumeSize, got nil")
+	}
+}